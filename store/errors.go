@@ -0,0 +1,29 @@
+package main
+
+import "errors"
+
+var (
+	// ErrNeedleChecksum is returned when a needle's footer CRC32 doesn't
+	// match its header+data, meaning the stored bytes are corrupt.
+	ErrNeedleChecksum = errors.New("needle: checksum mismatch")
+	// ErrNeedleFooter is returned when a needle's footer can't be parsed
+	// (bad magic), typically a torn write left over from a crash.
+	ErrNeedleFooter = errors.New("needle: invalid footer")
+	// ErrSuperBlockMmapCap is returned by initMmap when
+	// SuperBlockOptions.MemoryMapMaxSizeMb is smaller than the block file
+	// already is; NewSuperBlock logs it and uses the buffered backend.
+	ErrSuperBlockMmapCap = errors.New("store: memory map cap smaller than existing block data")
+	// ErrSuperBlockNotMmapped is returned by SuperBlock.GetZeroCopy when the
+	// block wasn't opened with SuperBlockOptions.MemoryMapMaxSizeMb; callers
+	// should fall back to Get.
+	ErrSuperBlockNotMmapped = errors.New("store: super block is not memory-mapped")
+	// ErrSuperBlockMmapBounds is returned by Get/GetZeroCopy on the mmap
+	// backend when offset/size falls outside b.mmapped, e.g. a stale index
+	// entry or a caller bug, rather than letting the slice expression panic.
+	ErrSuperBlockMmapBounds = errors.New("store: offset out of memory-mapped bounds")
+	// ErrSuperBlockMmapCompact is returned by Compact/CommitCompact for a
+	// memory-mapped block: compaction renames a freshly written file over
+	// b.File, which would require re-fallocating and re-mmapping it, so
+	// mmap-backed blocks aren't compacted in place yet.
+	ErrSuperBlockMmapCompact = errors.New("store: compaction is not supported for memory-mapped blocks")
+)
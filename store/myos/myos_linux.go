@@ -0,0 +1,98 @@
+//go:build linux
+// +build linux
+
+// Package myos wraps the Linux syscalls bfs uses to control when dirty
+// needle data hits disk and when it gets evicted from the page cache,
+// so large volumes don't leave unbounded dirty pages behind after a write.
+package myos
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// SyncFileRangeWrite mirrors SYNC_FILE_RANGE_WRITE from <linux/fs.h>: start
+// write-out of the range's dirty pages and return without waiting for it.
+const SyncFileRangeWrite = 2
+
+// posixFadvDontNeed mirrors POSIX_FADV_DONTNEED from <bits/fcntl-linux.h>.
+const posixFadvDontNeed = 4
+
+// posixMadvWillNeed mirrors MADV_WILLNEED from <sys/mman.h>.
+const posixMadvWillNeed = 3
+
+// msAsync mirrors MS_ASYNC from <sys/mman.h>: schedule dirty pages to be
+// written back without waiting for the write to complete.
+const msAsync = 1
+
+// SyncFileRange wraps sync_file_range(2), pushing [offset, offset+nbytes)
+// of f's data out to disk without syncing metadata or the whole file.
+func SyncFileRange(f *os.File, offset, nbytes int64, flags uint) (err error) {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_SYNC_FILE_RANGE, f.Fd(), uintptr(offset), uintptr(nbytes), uintptr(flags), 0, 0); errno != 0 {
+		err = errno
+	}
+	return
+}
+
+// Fdatasync wraps fdatasync(2).
+func Fdatasync(f *os.File) (err error) {
+	if _, _, errno := syscall.Syscall(syscall.SYS_FDATASYNC, f.Fd(), 0, 0); errno != 0 {
+		err = errno
+	}
+	return
+}
+
+// FadviseDontNeed wraps posix_fadvise(2) with POSIX_FADV_DONTNEED, telling
+// the kernel the given range can be dropped from the page cache once clean.
+func FadviseDontNeed(f *os.File, offset, length int64) (err error) {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(offset), uintptr(length), uintptr(posixFadvDontNeed), 0, 0); errno != 0 {
+		err = errno
+	}
+	return
+}
+
+// Fallocate wraps fallocate(2), preallocating size bytes for f so a
+// memory-mapped SuperBlock never has to grow the underlying file once mapped.
+func Fallocate(f *os.File, size int64) (err error) {
+	if _, _, errno := syscall.Syscall6(syscall.SYS_FALLOCATE, f.Fd(), 0, 0, uintptr(size), 0, 0); errno != 0 {
+		err = errno
+	}
+	return
+}
+
+// Mmap maps f's first size bytes read-write and shared, so writes land
+// straight in the page cache backing the file.
+func Mmap(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// Munmap unmaps a region previously returned by Mmap.
+func Munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
+
+// MsyncAsync wraps msync(2) with MS_ASYNC, scheduling b's dirty pages to be
+// written back without blocking for completion.
+func MsyncAsync(b []byte) (err error) {
+	if len(b) == 0 {
+		return
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(msAsync)); errno != 0 {
+		err = errno
+	}
+	return
+}
+
+// MadviseWillNeed wraps madvise(2) with MADV_WILLNEED, advising the kernel
+// to read b's pages back in ahead of an expected access (used by
+// SuperBlock.GetZeroCopy after FadviseDontNeed may have evicted them).
+func MadviseWillNeed(b []byte) (err error) {
+	if len(b) == 0 {
+		return
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_MADVISE, uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(posixMadvWillNeed)); errno != 0 {
+		err = errno
+	}
+	return
+}
@@ -0,0 +1,60 @@
+//go:build !linux
+// +build !linux
+
+package myos
+
+import (
+	"errors"
+	"os"
+)
+
+// SyncFileRangeWrite has no portable equivalent; kept so callers compile.
+const SyncFileRangeWrite = 0
+
+// ErrMmapUnsupported is returned by Fallocate/Mmap on platforms without a
+// supported preallocate-and-map path, telling SuperBlock to fall back to
+// its buffered os.File/bufio.Writer backend.
+var ErrMmapUnsupported = errors.New("myos: mmap unsupported on this platform")
+
+// SyncFileRange falls back to a full Sync on platforms without
+// sync_file_range(2).
+func SyncFileRange(f *os.File, offset, nbytes int64, flags uint) error {
+	return f.Sync()
+}
+
+// Fdatasync falls back to Sync on platforms without fdatasync(2).
+func Fdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+// FadviseDontNeed is a no-op on platforms without posix_fadvise(2); the
+// kernel manages the page cache on its own.
+func FadviseDontNeed(f *os.File, offset, length int64) error {
+	return nil
+}
+
+// Fallocate always fails with ErrMmapUnsupported here; SuperBlock treats
+// that as "use the buffered backend instead".
+func Fallocate(f *os.File, size int64) error {
+	return ErrMmapUnsupported
+}
+
+// Mmap always fails with ErrMmapUnsupported here.
+func Mmap(f *os.File, size int) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+// Munmap is unreachable without a prior successful Mmap; kept so callers compile.
+func Munmap(b []byte) error {
+	return nil
+}
+
+// MsyncAsync is unreachable without a prior successful Mmap; kept so callers compile.
+func MsyncAsync(b []byte) error {
+	return nil
+}
+
+// MadviseWillNeed is unreachable without a prior successful Mmap; kept so callers compile.
+func MadviseWillNeed(b []byte) error {
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	// size
+	NeedleChecksumSize    = 4
+	NeedleFooterMagicSize = 4
+	NeedleFooterSize      = NeedleChecksumSize + NeedleFooterMagicSize
+	// offset
+	NeedleChecksumOffset    = 0
+	NeedleFooterMagicOffset = NeedleChecksumOffset + NeedleChecksumSize
+)
+
+var (
+	needleFooterMagic = []byte{0xfe, 0xed, 0xfa, 0xce}
+	needleCRCTable    = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// ParseFooter validates the trailing footer appended after a needle's
+// header+data: a CRC32 (Castagnoli) over headerAndData, followed by a fixed
+// magic marker. It returns ErrNeedleFooter if the magic doesn't match (the
+// bytes aren't a footer at all, e.g. a torn write) or ErrNeedleChecksum if
+// the magic matches but the checksum doesn't.
+func (n *Needle) ParseFooter(headerAndData, footer []byte) (err error) {
+	if len(footer) < NeedleFooterSize {
+		err = ErrNeedleFooter
+		return
+	}
+	if !bytes.Equal(footer[NeedleFooterMagicOffset:NeedleFooterMagicOffset+NeedleFooterMagicSize], needleFooterMagic) {
+		err = ErrNeedleFooter
+		return
+	}
+	crc := binary.BigEndian.Uint32(footer[NeedleChecksumOffset : NeedleChecksumOffset+NeedleChecksumSize])
+	if crc != crc32.Checksum(headerAndData, needleCRCTable) {
+		err = ErrNeedleChecksum
+		return
+	}
+	return
+}
+
+// FillNeedleFooter computes the CRC32 of headerAndData and writes it plus
+// the magic marker into footer, which must be at least NeedleFooterSize
+// long. Add/Write/Repair/appendCompact call this right after FillNeedle so
+// every needle on disk carries a footer Get/Recovery can verify against.
+func FillNeedleFooter(headerAndData, footer []byte) {
+	binary.BigEndian.PutUint32(footer[NeedleChecksumOffset:NeedleChecksumOffset+NeedleChecksumSize], crc32.Checksum(headerAndData, needleCRCTable))
+	copy(footer[NeedleFooterMagicOffset:NeedleFooterMagicOffset+NeedleFooterMagicSize], needleFooterMagic)
+}
+
+// readNeedleFooter peeks and validates the footer following a needle whose
+// raw header+data bytes are hdrData, discarding the footer from rd on
+// success. walkNeedles stops scanning at any error here (an io.EOF counts as
+// a clean end); Recovery treats the rest as the torn tail of a partial append
+// and resets the writer to the last good offset, while Dump/Scan/Compact/
+// CommitCompact return the error to their caller.
+func readNeedleFooter(rd *bufio.Reader, n *Needle, hdrData []byte) (err error) {
+	var footer []byte
+	if footer, err = rd.Peek(NeedleFooterSize); err != nil {
+		return
+	}
+	if err = n.ParseFooter(hdrData, footer); err != nil {
+		return
+	}
+	_, err = rd.Discard(NeedleFooterSize)
+	return
+}
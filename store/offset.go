@@ -0,0 +1,43 @@
+package main
+
+import "encoding/binary"
+
+// Offset is the on-disk packed position of a needle inside its block: an
+// actual file byte offset divided by NeedlePaddingSize. Low is always
+// present, and alone is what a superBlockVer1 index record stores on disk;
+// High is only populated (and persisted) once a volume negotiates
+// superBlockVerExt, which raises a single volume's addressable range from
+// superBlockMaxSize to superBlockMaxSizeExt without growing the index
+// record size of deployments that never opt in.
+type Offset struct {
+	Low  [4]byte
+	High byte
+}
+
+// Uint64 returns the packed value as a plain integer.
+func (o Offset) Uint64() uint64 {
+	return uint64(o.High)<<32 | uint64(binary.BigEndian.Uint32(o.Low[:]))
+}
+
+// NewOffset packs v, an actual offset already divided by NeedlePaddingSize,
+// into an Offset.
+func NewOffset(v uint64) (o Offset) {
+	binary.BigEndian.PutUint32(o.Low[:], uint32(v))
+	o.High = byte(v >> 32)
+	return
+}
+
+// Add returns o advanced by delta packed units.
+func (o Offset) Add(delta uint32) Offset {
+	return NewOffset(o.Uint64() + uint64(delta))
+}
+
+// ToActualOffset converts a packed Offset back into a real file byte offset.
+func (o Offset) ToActualOffset() int64 {
+	return int64(o.Uint64()) * NeedlePaddingSize
+}
+
+// FromActualOffset packs a real file byte offset into an Offset.
+func FromActualOffset(actual int64) Offset {
+	return NewOffset(uint64(actual) / NeedlePaddingSize)
+}
@@ -6,8 +6,18 @@ import (
 	log "github.com/golang/glog"
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bfs/store/myos"
 )
 
+// followPollInterval is how often Follow re-scans a block for needles
+// appended since its last pass; Follow polls and uses no OS-level wakeup
+// such as inotify.
+const followPollInterval = 200 * time.Millisecond
+
 const (
 	// offset
 	superBlockHeaderOffset = 8
@@ -22,36 +32,113 @@ const (
 	superBlockPaddingOffset = superBlockVerOffset + superBlockPaddingSize
 	// ver
 	superBlockVer1 = byte(1)
+	// superBlockVerExt negotiates the extended, 5-byte form of Offset: new
+	// volumes created with NewSuperBlock(file, true, opts) write this
+	// version so later opens know to read/write the High byte too.
+	superBlockVerExt = byte(2)
 	// limits
 	// 32GB, offset aligned 8 bytes, 4GB * 8
 	superBlockMaxSize   = 4 * 1024 * 1024 * 1024 * 8
 	superBlockMaxOffset = 4294967295
+	// superBlockMaxSizeExt/superBlockMaxOffsetExt: with the 5-byte Offset a
+	// volume can address 1TB * 8 = 8TB before running out of space.
+	superBlockMaxSizeExt   = 1 << 40 * 8
+	superBlockMaxOffsetExt = 1<<40 - 1
 )
 
 var (
 	superBlockMagic   = []byte{0xab, 0xcd, 0xef, 0x00}
-	superBlockVer     = []byte{superBlockVer1}
 	superBlockPadding = []byte{0x00, 0x00, 0x00}
 )
 
+// SuperBlockOptions configures the optional SuperBlock backends NewSuperBlock
+// can choose between. The zero value selects the default os.File/bufio.Writer
+// backend.
+type SuperBlockOptions struct {
+	// MemoryMapMaxSizeMb, if > 0, makes NewSuperBlock fallocate the file to
+	// this many megabytes and mmap it read-write instead of going through
+	// bufio, so Add/Write/Repair/Get/Del operate directly on a byte slice.
+	// NewSuperBlock falls back to the default backend if the file is
+	// already larger than this cap, or if mmap isn't available on this
+	// platform (see myos). Intended for small, read-heavy "hot" volumes
+	// where letting the kernel manage a bounded, preallocated working set
+	// beats read()/write() through the page cache.
+	MemoryMapMaxSizeMb int
+}
+
 // An Volume contains one superblock and many needles.
 type SuperBlock struct {
 	r      *os.File
 	w      *os.File
 	bw     *bufio.Writer
 	File   string
-	offset uint32
+	offset Offset
 	Magic  []byte
 	Ver    byte
 	buf    [NeedleMaxSize]byte
+	// ext is true once this volume has negotiated superBlockVerExt, i.e.
+	// Offset.High is meaningful and gets persisted.
+	ext bool
+	// syncOffset is the end of the range already synced and (optionally)
+	// evicted from the page cache; Flush only has to deal with [syncOffset, offset).
+	syncOffset Offset
+	// writes counts Add calls since the last sync, used to drive SyncAtWrite.
+	writes int
+	// SyncAtWrite, if > 0, syncs the written range (and, with
+	// FadviseDontNeed, evicts it from the page cache) every SyncAtWrite Add
+	// calls and on every Flush, instead of leaving dirty pages to accumulate
+	// for the whole volume's lifetime. Write calls are not counted; on the
+	// mmap backend Add does not sync.
+	SyncAtWrite int
+	// UseSyncFileRange syncs via sync_file_range(SYNC_FILE_RANGE_WRITE)
+	// instead of fdatasync; it's cheaper but Linux-only (falls back to
+	// Sync on other platforms, see myos).
+	UseSyncFileRange bool
+	// FadviseDontNeed advises the kernel to drop the just-synced range from
+	// the page cache via posix_fadvise(POSIX_FADV_DONTNEED).
+	FadviseDontNeed bool
+	// mutex guards r/w/bw against being swapped out from under a writer by
+	// CommitCompact; Add/Write/Repair/Get/Del hold it for read, CommitCompact
+	// takes it exclusively for the brief rename-and-reopen, and Compact takes
+	// it exclusively to flush bw and snapshot offset.
+	mutex sync.RWMutex
+	// contentSize/deletedSize track live vs dead bytes so garbageLevel can
+	// tell an operator/vacuum loop when this block is worth compacting.
+	contentSize int64
+	deletedSize int64
+	// compaction state, set by Compact and consumed by CommitCompact.
+	lastCompactOffset      Offset
+	lastCompactIndexOffset int64
+	compactOffset          Offset
+	compactOffsets         map[int64]Offset
+	// compactSrcOffsets maps a key copied into .cpd during Compact's live
+	// walk to its offset in the *source* block, so CommitCompact can re-read
+	// the flag byte there: Del flips a needle's flag in place at its
+	// original offset, which the tombstone replay (bounded to
+	// [lastCompactOffset, end)) never observes if that offset is earlier
+	// than lastCompactOffset.
+	compactSrcOffsets map[int64]Offset
+	// mmapped is the memory-mapped backing file when this block uses the
+	// mmap backend (see SuperBlockOptions.MemoryMapMaxSizeMb); nil means the
+	// default os.File/bufio.Writer backend is in use. w/r/bw still hold the
+	// open file and are used for Close's final sync and for the non-mmap
+	// fallback path.
+	mmapped []byte
+	// mmapRefs counts outstanding GetZeroCopy readers of mmapped.
+	mmapRefs int32
 }
 
-// NewSuperBlock new a super block struct.
-func NewSuperBlock(file string) (b *SuperBlock, err error) {
-	b = &SuperBlock{}
+// NewSuperBlock new a super block struct. ext negotiates superBlockVerExt
+// for a brand new file, letting the volume grow past superBlockMaxSize; it
+// has no effect when opening an existing block, whose version on disk wins.
+// opts.MemoryMapMaxSizeMb, if set, switches the block onto the mmap backend
+// (see SuperBlockOptions); NewSuperBlock falls back to the default
+// os.File/bufio.Writer backend if that doesn't pan out.
+func NewSuperBlock(file string, ext bool, opts SuperBlockOptions) (b *SuperBlock, err error) {
+	b = &SuperBlock{ext: ext}
 	b.File = file
-	if b.w, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0664); err != nil {
-		log.Errorf("os.OpenFile(\"%s\", os.O_WRONLY|os.O_CREATE, 0664) error(%v)", file, err)
+	if b.w, err = os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDWR|os.O_CREATE, 0664) error(%v)", file, err)
 		return
 	}
 	if b.r, err = os.OpenFile(file, os.O_RDONLY, 0664); err != nil {
@@ -62,7 +149,15 @@ func NewSuperBlock(file string) (b *SuperBlock, err error) {
 		log.Errorf("block: %s init error(%v)", file, err)
 		goto failed
 	}
-	b.bw = bufio.NewWriterSize(b.w, NeedleMaxSize)
+	if opts.MemoryMapMaxSizeMb > 0 {
+		if err = b.initMmap(opts.MemoryMapMaxSizeMb); err != nil {
+			log.Errorf("block: %s memory map unavailable, falling back to buffered i/o, error(%v)", file, err)
+			err = nil
+		}
+	}
+	if b.mmapped == nil {
+		b.bw = bufio.NewWriterSize(b.w, NeedleMaxSize)
+	}
 	return
 failed:
 	if b.w != nil {
@@ -74,6 +169,30 @@ failed:
 	return
 }
 
+// initMmap preallocates the block file to capMb megabytes and maps it
+// read-write, so subsequent Add/Write/Repair/Get/Del calls use b.mmapped
+// instead of b.w/b.r/b.bw. It fails (leaving b.mmapped nil) with
+// ErrSuperBlockMmapCap if capMb is smaller than the file already is, or
+// with whatever myos.Fallocate/Mmap returned (e.g. myos.ErrMmapUnsupported
+// on a platform without mmap support).
+func (b *SuperBlock) initMmap(capMb int) (err error) {
+	var stat os.FileInfo
+	size := int64(capMb) * 1024 * 1024
+	if stat, err = b.w.Stat(); err != nil {
+		return
+	}
+	if size < stat.Size() {
+		return ErrSuperBlockMmapCap
+	}
+	if err = myos.Fallocate(b.w, size); err != nil {
+		return
+	}
+	if b.mmapped, err = myos.Mmap(b.w, int(size)); err != nil {
+		return
+	}
+	return
+}
+
 // init block file, add/parse meta info
 func (b *SuperBlock) init() (err error) {
 	var (
@@ -84,12 +203,16 @@ func (b *SuperBlock) init() (err error) {
 	}
 	// new file
 	if stat.Size() == 0 {
+		b.Ver = superBlockVer1
+		if b.ext {
+			b.Ver = superBlockVerExt
+		}
 		// magic
 		if _, err = b.w.Write(superBlockMagic); err != nil {
 			return
 		}
 		// ver
-		if _, err = b.w.Write(superBlockVer); err != nil {
+		if _, err = b.w.Write([]byte{b.Ver}); err != nil {
 			return
 		}
 		// padding
@@ -108,131 +231,330 @@ func (b *SuperBlock) init() (err error) {
 			err = ErrSuperBlockMagic
 			return
 		}
-		if b.Ver == superBlockVer1 {
+		if b.Ver != superBlockVer1 && b.Ver != superBlockVerExt {
 			err = ErrSuperBlockVer
 			return
 		}
+		b.ext = b.Ver == superBlockVerExt
 		if _, err = b.w.Seek(superBlockHeaderOffset, os.SEEK_SET); err != nil {
 			return
 		}
 	}
-	b.offset = NeedleOffset(superBlockHeaderOffset)
+	b.offset = FromActualOffset(superBlockHeaderOffset)
+	b.syncOffset = b.offset
+	return
+}
+
+// maxOffset is the largest packed Offset this block may reach, depending on
+// whether it negotiated the extended (superBlockVerExt) form.
+func (b *SuperBlock) maxOffset() uint64 {
+	if b.ext {
+		return superBlockMaxOffsetExt
+	}
+	return superBlockMaxOffset
+}
+
+// sync syncs and (optionally) evicts the delta range [syncOffset, offset)
+// from the page cache, according to SyncAtWrite/UseSyncFileRange/FadviseDontNeed.
+func (b *SuperBlock) sync() (err error) {
+	if b.syncOffset.Uint64() >= b.offset.Uint64() {
+		return
+	}
+	from := BlockOffset(b.syncOffset)
+	nbytes := BlockOffset(b.offset) - from
+	if b.UseSyncFileRange {
+		err = myos.SyncFileRange(b.w, from, nbytes, myos.SyncFileRangeWrite)
+	} else {
+		err = myos.Fdatasync(b.w)
+	}
+	if err != nil {
+		log.Errorf("block: %s sync error(%v)", b.File, err)
+		return
+	}
+	if b.FadviseDontNeed {
+		if err = myos.FadviseDontNeed(b.w, from, nbytes); err != nil {
+			log.Errorf("block: %s fadvise error(%v)", b.File, err)
+			return
+		}
+	}
+	b.syncOffset = b.offset
 	return
 }
 
 // Add append a photo to the block.
-func (b *SuperBlock) Add(key, cookie int64, data []byte) (offset uint32, size int32, err error) {
+func (b *SuperBlock) Add(key, cookie int64, data []byte) (offset Offset, size int32, err error) {
 	var (
 		padding    int32
+		hdrSize    int32
 		incrOffset uint32
 		dataSize   = int32(len(data))
 	)
-	padding, size = NeedleSize(dataSize)
+	padding, hdrSize = NeedleSize(dataSize)
+	size = hdrSize + NeedleFooterSize
 	incrOffset = NeedleOffset(size)
-	if superBlockMaxOffset-incrOffset < b.offset {
-		err = ErrSuperBlockNoSpace
-		return
-	}
 	FillNeedle(padding, dataSize, key, cookie, data, b.buf[:])
-	if _, err = b.w.Write(b.buf[:size]); err != nil {
+	FillNeedleFooter(b.buf[:hdrSize], b.buf[hdrSize:size])
+	// b.offset is read and advanced under mutex so Compact's snapshot of it
+	// (lastCompactOffset) can't race this write, the way the rest of b's
+	// fields not guarded against CommitCompact's exclusive lock would.
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.maxOffset()-uint64(incrOffset) < b.offset.Uint64() {
+		err = ErrSuperBlockNoSpace
 		return
 	}
 	offset = b.offset
-	b.offset += incrOffset
-	// TODO append N times call flush then clean the os page cache
-	// page cache no used here...
-	// after upload a photo, we cache in user-level.
+	if b.mmapped != nil {
+		start := offset.ToActualOffset()
+		if start+int64(size) > int64(len(b.mmapped)) {
+			err = ErrSuperBlockNoSpace
+			return
+		}
+		copy(b.mmapped[start:], b.buf[:size])
+	} else {
+		if _, err = b.w.Write(b.buf[:size]); err != nil {
+			return
+		}
+	}
+	b.offset = b.offset.Add(incrOffset)
+	b.contentSize += int64(size)
+	if b.mmapped == nil && b.SyncAtWrite > 0 {
+		b.writes++
+		if b.writes >= b.SyncAtWrite {
+			b.writes = 0
+			if err = b.sync(); err != nil {
+				return
+			}
+		}
+	}
 	log.V(1).Infof("add a needle, cur offset: %d", b.offset)
 	return
 }
 
 // Write start add needles to the block, must called after start a transaction.
-func (b *SuperBlock) Write(key, cookie int64, data []byte) (offset uint32, size int32, err error) {
+// On the mmap backend there's no separate write buffer to flush later, so it
+// behaves exactly like Add.
+func (b *SuperBlock) Write(key, cookie int64, data []byte) (offset Offset, size int32, err error) {
+	if b.mmapped != nil {
+		return b.Add(key, cookie, data)
+	}
 	var (
 		padding    int32
+		hdrSize    int32
 		incrOffset uint32
 		dataSize   = int32(len(data))
 	)
-	padding, size = NeedleSize(dataSize)
+	padding, hdrSize = NeedleSize(dataSize)
+	size = hdrSize + NeedleFooterSize
 	incrOffset = NeedleOffset(size)
-	if superBlockMaxOffset-incrOffset < b.offset {
+	FillNeedle(padding, dataSize, key, cookie, data, b.buf[:])
+	FillNeedleFooter(b.buf[:hdrSize], b.buf[hdrSize:size])
+	// b.offset is read and advanced under mutex so Compact's snapshot of it
+	// (lastCompactOffset) can't race this write; see the same comment in Add.
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.maxOffset()-uint64(incrOffset) < b.offset.Uint64() {
 		err = ErrSuperBlockNoSpace
 		return
 	}
-	FillNeedle(padding, dataSize, key, cookie, data, b.buf[:])
 	if _, err = b.bw.Write(b.buf[:size]); err != nil {
 		return
 	}
 	offset = b.offset
-	// WARN b.offset is dirty data here
-	b.offset += incrOffset
+	b.offset = b.offset.Add(incrOffset)
+	b.contentSize += int64(size)
 	return
 }
 
-// Flush flush writer buffer.
+// Flush flush writer buffer, then sync and evict the synced delta from the
+// page cache if configured to do so. On the mmap backend it's msync(MS_ASYNC).
 func (b *SuperBlock) Flush() (err error) {
+	if b.mmapped != nil {
+		return myos.MsyncAsync(b.mmapped)
+	}
 	if err = b.bw.Flush(); err != nil {
 		return
 	}
-	// TODO append N times call flush then clean the os page cache
-	// page cache no used here...
-	// after upload a photo, we cache in user-level.
+	if b.SyncAtWrite > 0 {
+		err = b.sync()
+	}
 	return
 }
 
 // Repair repair the specified offset needle without update current offset.
-func (b *SuperBlock) Repair(key, cookie int64, data []byte, offset uint32) (err error) {
+func (b *SuperBlock) Repair(key, cookie int64, data []byte, offset Offset) (err error) {
 	var (
 		size     int32
+		hdrSize  int32
 		padding  int32
 		dataSize = int32(len(data))
 	)
-	padding, size = NeedleSize(dataSize)
+	padding, hdrSize = NeedleSize(dataSize)
+	size = hdrSize + NeedleFooterSize
 	FillNeedle(padding, dataSize, key, cookie, data, b.buf[:])
-	if _, err = b.w.WriteAt(b.buf[:size], BlockOffset(offset)); err != nil {
+	FillNeedleFooter(b.buf[:hdrSize], b.buf[hdrSize:size])
+	if b.mmapped != nil {
+		b.mutex.RLock()
+		copy(b.mmapped[BlockOffset(offset):], b.buf[:size])
+		b.mutex.RUnlock()
+		if b.SyncAtWrite > 0 {
+			err = myos.MsyncAsync(b.mmapped)
+		}
+		return
+	}
+	b.mutex.RLock()
+	_, err = b.w.WriteAt(b.buf[:size], BlockOffset(offset))
+	b.mutex.RUnlock()
+	if err != nil {
+		return
+	}
+	if b.SyncAtWrite > 0 {
+		if b.UseSyncFileRange {
+			err = myos.SyncFileRange(b.w, BlockOffset(offset), int64(size), myos.SyncFileRangeWrite)
+		} else {
+			err = myos.Fdatasync(b.w)
+		}
+		if err != nil {
+			log.Errorf("block: %s repair sync error(%v)", b.File, err)
+			return
+		}
+		if b.FadviseDontNeed {
+			if err = myos.FadviseDontNeed(b.w, BlockOffset(offset), int64(size)); err != nil {
+				log.Errorf("block: %s repair fadvise error(%v)", b.File, err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// Get get a needle from super block, buf must be sized to hold the needle's
+// header, data and footer. The footer's CRC32 is checked against the read
+// bytes before they're handed back, returning ErrNeedleChecksum on mismatch.
+func (b *SuperBlock) Get(offset Offset, buf []byte) (err error) {
+	var n = &Needle{}
+	if b.mmapped != nil {
+		b.mutex.RLock()
+		start := BlockOffset(offset)
+		if start < 0 || start+int64(len(buf)) > int64(len(b.mmapped)) {
+			b.mutex.RUnlock()
+			err = ErrSuperBlockMmapBounds
+			return
+		}
+		copy(buf, b.mmapped[start:start+int64(len(buf))])
+		b.mutex.RUnlock()
+	} else {
+		b.mutex.RLock()
+		_, err = b.r.ReadAt(buf, BlockOffset(offset))
+		b.mutex.RUnlock()
+		if err != nil {
+			return
+		}
+	}
+	if err = n.ParseHeader(buf[:NeedleHeaderSize]); err != nil {
+		return
+	}
+	dataEnd := NeedleHeaderSize + n.DataSize
+	if err = n.ParseData(buf[NeedleHeaderSize:dataEnd]); err != nil {
+		return
+	}
+	if err = n.ParseFooter(buf[:dataEnd], buf[dataEnd:]); err != nil {
 		return
 	}
-	// TODO append N times call flush then clean the os page cache
-	// page cache no used here...
-	// after upload a photo, we cache in user-level.
 	return
 }
 
-// Get get a needle from super block.
-func (b *SuperBlock) Get(offset uint32, buf []byte) (err error) {
-	if _, err = b.r.ReadAt(buf, BlockOffset(offset)); err != nil {
+// GetZeroCopy is Get without the copy: on the mmap backend it hands back a
+// slice straight into the mapped region, advising the kernel the page is
+// about to be read (madvise(WILLNEED), undoing any prior FadviseDontNeed
+// eviction) and bumping mmapRefs until release is called. It returns
+// ErrSuperBlockNotMmapped on the default backend; callers should fall back
+// to Get in that case.
+func (b *SuperBlock) GetZeroCopy(offset Offset, size int32) (data []byte, release func(), err error) {
+	if b.mmapped == nil {
+		err = ErrSuperBlockNotMmapped
+		return
+	}
+	var n = &Needle{}
+	b.mutex.RLock()
+	start := BlockOffset(offset)
+	if start < 0 || start+int64(size) > int64(len(b.mmapped)) {
+		b.mutex.RUnlock()
+		err = ErrSuperBlockMmapBounds
+		return
+	}
+	buf := b.mmapped[start : start+int64(size)]
+	myos.MadviseWillNeed(buf)
+	atomic.AddInt32(&b.mmapRefs, 1)
+	b.mutex.RUnlock()
+	release = func() { atomic.AddInt32(&b.mmapRefs, -1) }
+	if err = n.ParseHeader(buf[:NeedleHeaderSize]); err != nil {
+		release()
 		return
 	}
+	dataEnd := NeedleHeaderSize + n.DataSize
+	if err = n.ParseData(buf[NeedleHeaderSize:dataEnd]); err != nil {
+		release()
+		return
+	}
+	if err = n.ParseFooter(buf[:dataEnd], buf[dataEnd:]); err != nil {
+		release()
+		return
+	}
+	data = buf
 	return
 }
 
 // Del logical del a needls, only update the flag to it.
-func (b *SuperBlock) Del(offset uint32) (err error) {
+func (b *SuperBlock) Del(offset Offset, size int32) (err error) {
+	if b.mmapped != nil {
+		b.mutex.RLock()
+		b.mmapped[BlockOffset(offset)+NeedleFlagOffset] = NeedleStatusDelBytes[0]
+		b.mutex.RUnlock()
+		b.deletedSize += int64(size)
+		return
+	}
 	// WriteAt won't update the file offset.
-	if _, err = b.w.WriteAt(NeedleStatusDelBytes, BlockOffset(offset)+NeedleFlagOffset); err != nil {
+	b.mutex.RLock()
+	_, err = b.w.WriteAt(NeedleStatusDelBytes, BlockOffset(offset)+NeedleFlagOffset)
+	b.mutex.RUnlock()
+	if err != nil {
 		return
 	}
+	b.deletedSize += int64(size)
 	return
 }
 
-// Dump parse supper block file and dump print for debug.
-// ONLY DEBUG!!!!
-func (b *SuperBlock) Dump() (err error) {
+// garbageLevel returns the fraction of contentSize that is dead (logically
+// deleted) needles, so an operator/vacuum loop can decide when this block
+// is worth compacting.
+func (b *SuperBlock) garbageLevel() float64 {
+	if b.contentSize == 0 {
+		return 0
+	}
+	return float64(b.deletedSize) / float64(b.contentSize)
+}
+
+// walkNeedles reads needles one at a time from rd via the Peek/Discard
+// pattern, starting logically at offset, invoking fn with each needle's own
+// offset and on-disk size (header+data+footer). It stops at the first
+// unparseable trailing bytes (a torn write, or plain EOF) or as soon as fn
+// returns an error, and is the single needle-walk loop shared by
+// Dump/Recovery/Compact/CommitCompact/Scan. It returns the offset just past
+// the last needle it fully read, and nil error on a clean EOF.
+func walkNeedles(rd *bufio.Reader, offset Offset, fn func(n *Needle, soffset Offset, size int32) error) (noffset Offset, err error) {
 	var (
-		rd   *bufio.Reader
 		data []byte
 		n    = &Needle{}
 	)
-	if _, err = b.r.Seek(0, os.SEEK_SET); err != nil {
-		return
-	}
-	rd = bufio.NewReaderSize(b.r, NeedleMaxSize)
+	noffset = offset
 	for {
 		// header
 		if data, err = rd.Peek(NeedleHeaderSize); err != nil {
 			break
 		}
-		if err = n.ParseHeader(data); err != nil {
+		hdr := append([]byte(nil), data...)
+		if err = n.ParseHeader(hdr); err != nil {
 			break
 		}
 		if _, err = rd.Discard(NeedleHeaderSize); err != nil {
@@ -242,13 +564,22 @@ func (b *SuperBlock) Dump() (err error) {
 		if data, err = rd.Peek(n.DataSize); err != nil {
 			break
 		}
-		if err = n.ParseData(data); err != nil {
+		dat := append([]byte(nil), data...)
+		if err = n.ParseData(dat); err != nil {
 			break
 		}
 		if _, err = rd.Discard(n.DataSize); err != nil {
 			break
 		}
-		log.Info(n.String())
+		// footer, a bad one means a torn write tail: stop here
+		if err = readNeedleFooter(rd, n, append(hdr, dat...)); err != nil {
+			break
+		}
+		size := int32(NeedleHeaderSize + n.DataSize + NeedleFooterSize)
+		if err = fn(n, noffset, size); err != nil {
+			break
+		}
+		noffset = noffset.Add(NeedleOffset(size))
 	}
 	if err == io.EOF {
 		err = nil
@@ -256,135 +587,378 @@ func (b *SuperBlock) Dump() (err error) {
 	return
 }
 
+// Dump parse supper block file and dump print for debug.
+// ONLY DEBUG!!!!
+func (b *SuperBlock) Dump() (err error) {
+	if _, err = b.r.Seek(0, os.SEEK_SET); err != nil {
+		return
+	}
+	rd := bufio.NewReaderSize(b.r, NeedleMaxSize)
+	_, err = walkNeedles(rd, Offset{}, func(n *Needle, soffset Offset, size int32) error {
+		log.Info(n.String())
+		return nil
+	})
+	return
+}
+
 // Recovery recovery needles map from super block.
 func (b *SuperBlock) Recovery(needles map[int64]NeedleCache, indexer *Indexer, offset int64) (err error) {
 	var (
-		size    int32
-		data    []byte
-		rd      *bufio.Reader
-		n       = &Needle{}
-		nc      NeedleCache
-		noffset uint32
+		noffset Offset
+		addErr  error
 	)
 	log.Infof("start super block recovery, offset: %d\n", offset)
 	if offset == 0 {
 		offset = superBlockHeaderOffset
-		noffset = NeedleOffset(superBlockHeaderOffset)
+		noffset = FromActualOffset(superBlockHeaderOffset)
 	}
 	if _, err = b.r.Seek(offset, os.SEEK_SET); err != nil {
 		log.Errorf("block: %s seek error(%v)", b.File)
 		return
 	}
-	rd = bufio.NewReaderSize(b.r, NeedleMaxSize)
-	for {
-		// header
-		if data, err = rd.Peek(NeedleHeaderSize); err != nil {
-			break
-		}
-		if err = n.ParseHeader(data); err != nil {
-			break
-		}
-		if _, err = rd.Discard(NeedleHeaderSize); err != nil {
-			break
-		}
-		// data
-		if data, err = rd.Peek(n.DataSize); err != nil {
-			break
-		}
-		if err = n.ParseData(data); err != nil {
-			break
-		}
-		if _, err = rd.Discard(n.DataSize); err != nil {
-			break
-		}
-		size = int32(NeedleHeaderSize + n.DataSize)
+	rd := bufio.NewReaderSize(b.r, NeedleMaxSize)
+	noffset, err = walkNeedles(rd, noffset, func(n *Needle, soffset Offset, size int32) (err error) {
+		// size (as recorded in the index/needle cache) spans header, data
+		// and footer, matching what Get needs to re-verify the checksum.
+		b.contentSize += int64(size)
 		if n.Flag == NeedleStatusOK {
-			if err = indexer.Add(n.Key, noffset, size); err != nil {
-				break
+			if err = indexer.Add(n.Key, soffset, size); err != nil {
+				addErr = err
+				return
 			}
-			nc = NewNeedleCache(noffset, size)
+			needles[n.Key] = NewNeedleCache(soffset, size)
 		} else {
-			nc = NewNeedleCache(NeedleCacheDelOffset, size)
+			b.deletedSize += int64(size)
+			needles[n.Key] = NewNeedleCache(NeedleCacheDelOffset, size)
 		}
-		needles[n.Key] = nc
-		log.V(1).Infof("recovery needle: offset: %d, size: %d", noffset, size)
+		log.V(1).Infof("recovery needle: offset: %d, size: %d", soffset.Uint64(), size)
 		log.V(1).Info(n.String())
-		noffset += NeedleOffset(size)
-	}
-	if err == io.EOF {
-		err = nil
+		return
+	})
+	if addErr != nil {
+		err = addErr
+		return
 	}
+	// any other error stopped the walk at bytes that don't parse as a
+	// needle (e.g. a torn footer); the Seek below discards them.
 	// reset b.w offset, discard left space which can't parse to a needle
-	if _, err = b.w.Seek(BlockOffset(noffset), os.SEEK_SET); err != nil {
+	if _, err = b.w.Seek(noffset.ToActualOffset(), os.SEEK_SET); err != nil {
 		log.Errorf("reset block: %s offset error(%v)", b.File, err)
 		return
 	}
 	return
 }
 
-// Compress compress the orig block, copy to disk dst block.
-func (b *SuperBlock) Compress(v *Volume) (err error) {
-	var (
-		data []byte
-		r    *os.File
-		rd   *bufio.Reader
-		n    = &Needle{}
-	)
-	log.Infof("start super block compress: %s\n", b.File)
+// Scan walks the block starting at startOffset, invoking fn with every live
+// or deleted needle it finds and the offset just past it, until it reaches
+// the current end of what's been written. It returns the offset Follow
+// should resume from on its next pass. fn runs without b's lock held, so a
+// slow fn (e.g. shipping needles to a replication peer) can't starve
+// CommitCompact's writer lock. Scan opens its own read-only handle on
+// b.File rather than sharing b.r, so two Scans (e.g. two concurrent
+// Follow'ers mirroring to different peers) never interleave Seek/Read
+// against one file descriptor.
+func (b *SuperBlock) Scan(startOffset Offset, fn func(n *Needle, offset, nextOffset Offset) error) (noffset Offset, err error) {
+	var r *os.File
 	if r, err = os.OpenFile(b.File, os.O_RDONLY, 0664); err != nil {
 		log.Errorf("os.OpenFile(\"%s\", os.O_RDONLY, 0664) error(%v)", b.File, err)
 		return
 	}
-	if _, err = r.Seek(superBlockHeaderOffset, os.SEEK_SET); err != nil {
+	defer r.Close()
+	if _, err = r.Seek(startOffset.ToActualOffset(), os.SEEK_SET); err != nil {
 		return
 	}
-	rd = bufio.NewReaderSize(r, NeedleMaxSize)
+	rd := bufio.NewReaderSize(r, NeedleMaxSize)
+	return walkNeedles(rd, startOffset, func(n *Needle, soffset Offset, size int32) error {
+		return fn(n, soffset, soffset.Add(NeedleOffset(size)))
+	})
+}
+
+// Follow is Scan that doesn't stop at the live end of the block: once it
+// catches up it sleeps followPollInterval and scans again, so fn keeps
+// seeing newly appended needles as they land. It returns when stopCh is
+// closed or fn/Scan returns an error. This is the building block for a
+// replication subsystem to incrementally mirror a volume to a peer, the way
+// seaweedfs's VolumeTailSender does, instead of re-reading the whole block.
+func (b *SuperBlock) Follow(startOffset Offset, stopCh <-chan struct{}, fn func(n *Needle, offset, nextOffset Offset) error) (err error) {
+	noffset := startOffset
 	for {
-		// header
-		if data, err = rd.Peek(NeedleHeaderSize); err != nil {
-			break
-		}
-		if err = n.ParseHeader(data); err != nil {
-			break
-		}
-		if _, err = rd.Discard(NeedleHeaderSize); err != nil {
-			break
+		select {
+		case <-stopCh:
+			return
+		default:
 		}
-		// data
-		if data, err = rd.Peek(n.DataSize); err != nil {
-			break
+		if noffset, err = b.Scan(noffset, fn); err != nil {
+			return
 		}
-		if err = n.ParseData(data); err != nil {
-			break
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(followPollInterval):
 		}
-		if _, err = rd.Discard(n.DataSize); err != nil {
-			break
+	}
+}
+
+// Compact is phase 1 of a two-phase, in-place compaction: it streams live
+// needles from the source block into filePath+".cpd" and builds a fresh
+// index at filePath+".cpx", while b keeps accepting Add/Write calls. It
+// remembers lastCompactOffset/lastCompactIndexOffset at the moment the copy
+// started, so CommitCompact only has to replay what landed afterwards. This
+// replaces the old stop-the-world Compress and mirrors seaweedfs's vacuum.
+// It returns ErrSuperBlockMmapCompact for a memory-mapped block.
+func (b *SuperBlock) Compact(indexer *Indexer) (err error) {
+	if b.mmapped != nil {
+		return ErrSuperBlockMmapCompact
+	}
+	var (
+		r       *os.File
+		cpf     *os.File
+		cpx     *Indexer
+		doffset = FromActualOffset(superBlockHeaderOffset)
+		cpdFile = b.File + ".cpd"
+		cpxFile = b.File + ".cpx"
+		// compactBuf is a scratch buffer private to this Compact call: it
+		// must not share b.buf, which Add/Write/Repair keep writing to
+		// concurrently while compaction runs.
+		compactBuf [NeedleMaxSize]byte
+	)
+	log.Infof("start super block compact: %s -> %s\n", b.File, cpdFile)
+	if r, err = os.OpenFile(b.File, os.O_RDONLY, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDONLY, 0664) error(%v)", b.File, err)
+		return
+	}
+	defer r.Close()
+	if cpf, err = os.OpenFile(cpdFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0664) error(%v)", cpdFile, err)
+		return
+	}
+	defer cpf.Close()
+	if cpx, err = NewIndexer(cpxFile); err != nil {
+		log.Errorf("NewIndexer(\"%s\") error(%v)", cpxFile, err)
+		return
+	}
+	defer cpx.Close()
+	if _, err = cpf.Write(superBlockMagic); err != nil {
+		return
+	}
+	if _, err = cpf.Write([]byte{b.Ver}); err != nil {
+		return
+	}
+	if _, err = cpf.Write(superBlockPadding); err != nil {
+		return
+	}
+	// the source keeps growing under us; only copy up to where it stood
+	// when we started, CommitCompact replays the rest. Flush Write's buffered
+	// needles and snapshot b.offset holding the mutex exclusively, so no
+	// Add/Write (which hold it for read) can move b.offset meanwhile and
+	// everything before the snapshot is in the file for the walk below.
+	b.mutex.Lock()
+	err = b.bw.Flush()
+	b.lastCompactOffset = b.offset
+	b.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	b.lastCompactIndexOffset = indexer.Offset()
+	b.compactOffsets = make(map[int64]Offset)
+	// compactSrcOffsets remembers each live needle's offset in the *source*
+	// block, so CommitCompact can recheck whether it was deleted in place
+	// during the compaction window (see compactSrcOffsets field doc).
+	b.compactSrcOffsets = make(map[int64]Offset)
+	if _, err = r.Seek(superBlockHeaderOffset, os.SEEK_SET); err != nil {
+		return
+	}
+	// bound the reader to lastCompactOffset so walkNeedles stops there
+	// cleanly instead of racing the writer as b keeps growing under us.
+	span := b.lastCompactOffset.ToActualOffset() - superBlockHeaderOffset
+	rd := bufio.NewReaderSize(io.LimitReader(r, span), NeedleMaxSize)
+	_, err = walkNeedles(rd, FromActualOffset(superBlockHeaderOffset), func(n *Needle, soffset Offset, size int32) (err error) {
+		// skip delete needle, it's simply not carried over
+		if n.Flag != NeedleStatusDel {
+			if err = b.appendCompact(cpf, cpx, n, &doffset, compactBuf[:]); err != nil {
+				return
+			}
+			b.compactSrcOffsets[n.Key] = soffset
 		}
-		log.V(1).Info(n.String())
-		// skip delete needle
+		return
+	})
+	if err != nil {
+		return
+	}
+	b.compactOffset = doffset
+	return
+}
+
+// appendCompact writes a live needle to the compacted block at *doffset,
+// records it in the compacted index and in b.compactOffsets (so a later
+// tombstone can find it again), then advances *doffset past it. buf is the
+// caller's scratch buffer; Compact/CommitCompact each pass their own so
+// neither races the live b.buf that Add/Write/Repair keep writing to.
+func (b *SuperBlock) appendCompact(cpf *os.File, cpx *Indexer, n *Needle, doffset *Offset, buf []byte) (err error) {
+	var (
+		padding, hdrSize, size int32
+		dataSize               = int32(n.DataSize)
+	)
+	padding, hdrSize = NeedleSize(dataSize)
+	size = hdrSize + NeedleFooterSize
+	FillNeedle(padding, dataSize, n.Key, n.Cookie, n.Data, buf)
+	FillNeedleFooter(buf[:hdrSize], buf[hdrSize:size])
+	if _, err = cpf.WriteAt(buf[:size], doffset.ToActualOffset()); err != nil {
+		return
+	}
+	if err = cpx.Add(n.Key, *doffset, size); err != nil {
+		return
+	}
+	b.compactOffsets[n.Key] = *doffset
+	*doffset = doffset.Add(NeedleOffset(size))
+	return
+}
+
+// CommitCompact is phase 2: it takes a short write lock, replays whatever
+// was appended to the source block since Compact started (live needles are
+// appended to .cpd, deletes rewrite the flag byte at the needle's offset in
+// .cpd via b.compactOffsets), then atomically renames .cpd/.cpx over the
+// originals and re-opens r/w/bw on the compacted file. It returns
+// ErrSuperBlockMmapCompact for a memory-mapped block, matching Compact
+// (which never leaves one in the compacting state CommitCompact expects).
+func (b *SuperBlock) CommitCompact(indexer *Indexer) (err error) {
+	if b.mmapped != nil {
+		return ErrSuperBlockMmapCompact
+	}
+	var (
+		cpf     *os.File
+		cpx     *Indexer
+		doffset = b.compactOffset
+		cpdFile = b.File + ".cpd"
+		cpxFile = b.File + ".cpx"
+		idxFile = indexer.File
+		// commitBuf is this call's private scratch buffer; it must not
+		// share b.buf with the concurrent Add/Write/Repair paths.
+		commitBuf [NeedleMaxSize]byte
+		flag      [1]byte
+	)
+	log.Infof("start super block commit compact: %s\n", b.File)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if cpf, err = os.OpenFile(cpdFile, os.O_RDWR, 0664); err != nil {
+		log.Errorf("os.OpenFile(\"%s\", os.O_RDWR, 0664) error(%v)", cpdFile, err)
+		return
+	}
+	if cpx, err = NewIndexer(cpxFile); err != nil {
+		log.Errorf("NewIndexer(\"%s\") error(%v)", cpxFile, err)
+		cpf.Close()
+		return
+	}
+	// push Write's buffered needles into the source file so the replay
+	// below sees them before the file is replaced.
+	if err = b.bw.Flush(); err != nil {
+		goto failed
+	}
+	if _, err = b.r.Seek(b.lastCompactOffset.ToActualOffset(), os.SEEK_SET); err != nil {
+		goto failed
+	}
+	if _, err = walkNeedles(bufio.NewReaderSize(b.r, NeedleMaxSize), b.lastCompactOffset, func(n *Needle, soffset Offset, size int32) (err error) {
 		if n.Flag == NeedleStatusDel {
+			if off, ok := b.compactOffsets[n.Key]; ok {
+				if _, err = cpf.WriteAt(NeedleStatusDelBytes, off.ToActualOffset()+NeedleFlagOffset); err != nil {
+					return
+				}
+			}
+			// else: created and deleted entirely within the compaction
+			// window, it never made it into .cpd.
+			return
+		}
+		return b.appendCompact(cpf, cpx, n, &doffset, commitBuf[:])
+	}); err != nil {
+		goto failed
+	}
+	// A Del against a needle copied during Compact's live walk (source
+	// offset < lastCompactOffset) only flips its flag byte in place at that
+	// original offset; the replay above, bounded to
+	// [lastCompactOffset, end), never sees it. Recheck each such key
+	// against the source file before finalizing, or the compacted copy
+	// would silently resurrect data the caller believed deleted.
+	for key, srcOffset := range b.compactSrcOffsets {
+		dstOffset, ok := b.compactOffsets[key]
+		if !ok {
 			continue
 		}
-		// multi append
-		if err = v.Write(n.Key, n.Cookie, n.Data); err != nil {
-			break
+		if _, err = b.r.ReadAt(flag[:], srcOffset.ToActualOffset()+NeedleFlagOffset); err != nil {
+			goto failed
+		}
+		if flag[0] == NeedleStatusDelBytes[0] {
+			if _, err = cpf.WriteAt(NeedleStatusDelBytes, dstOffset.ToActualOffset()+NeedleFlagOffset); err != nil {
+				goto failed
+			}
 		}
 	}
-	if err != io.EOF {
+	if err = cpf.Sync(); err != nil {
+		goto failed
+	}
+	if err = cpf.Close(); err != nil {
+		goto failed
+	}
+	if err = cpx.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(cpdFile, b.File); err != nil {
+		log.Errorf("os.Rename(\"%s\", \"%s\") error(%v)", cpdFile, b.File, err)
+		return
+	}
+	if err = os.Rename(cpxFile, idxFile); err != nil {
+		log.Errorf("os.Rename(\"%s\", \"%s\") error(%v)", cpxFile, idxFile, err)
+		return
+	}
+	b.bw.Flush()
+	b.w.Close()
+	b.r.Close()
+	if b.w, err = os.OpenFile(b.File, os.O_WRONLY, 0664); err != nil {
 		return
 	}
-	if err = v.Flush(); err != nil {
+	if b.r, err = os.OpenFile(b.File, os.O_RDONLY, 0664); err != nil {
 		return
 	}
-	if err = r.Close(); err != nil {
+	if _, err = b.w.Seek(doffset.ToActualOffset(), os.SEEK_SET); err != nil {
 		return
 	}
+	b.bw = bufio.NewWriterSize(b.w, NeedleMaxSize)
+	b.offset = doffset
+	b.syncOffset = doffset
+	b.contentSize = doffset.ToActualOffset() - superBlockHeaderOffset
+	b.deletedSize = 0
+	b.lastCompactOffset = Offset{}
+	b.lastCompactIndexOffset = 0
+	b.compactOffset = Offset{}
+	b.compactOffsets = nil
+	b.compactSrcOffsets = nil
+	return
+failed:
+	cpf.Close()
+	cpx.Close()
 	return
 }
 
 func (b *SuperBlock) Close() {
 	var err error
-	if err = b.bw.Flush(); err != nil {
+	if b.mmapped != nil {
+		// Take the lock so no new GetZeroCopy can start, then wait for
+		// readers already holding a slice into b.mmapped to call release()
+		// before unmapping under them, or they'd segfault on unmapped
+		// memory instead of hitting a recoverable error.
+		b.mutex.Lock()
+		for atomic.LoadInt32(&b.mmapRefs) > 0 {
+			b.mutex.Unlock()
+			time.Sleep(time.Millisecond)
+			b.mutex.Lock()
+		}
+		if err = myos.MsyncAsync(b.mmapped); err != nil {
+			log.Errorf("block: %s msync error(%v)", b.File, err)
+		}
+		if err = myos.Munmap(b.mmapped); err != nil {
+			log.Errorf("block: %s munmap error(%v)", b.File, err)
+		}
+		b.mutex.Unlock()
+	} else if err = b.bw.Flush(); err != nil {
 		log.Errorf("block: %s flush error(%v)", b.File, err)
 	}
 	if err = b.w.Sync(); err != nil {
@@ -400,6 +974,6 @@ func (b *SuperBlock) Close() {
 }
 
 // BlockOffset get super block file offset.
-func BlockOffset(offset uint32) int64 {
-	return int64(offset) * NeedlePaddingSize
+func BlockOffset(offset Offset) int64 {
+	return offset.ToActualOffset()
 }
\ No newline at end of file
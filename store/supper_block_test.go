@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestSuperBlockAddGetChecksum is the "write then Get" round trip that
+// should catch a needle footer never actually making it to disk: Add
+// writes a needle, Get must be able to read the same bytes back, and
+// flipping a data byte on disk afterwards must turn into
+// ErrNeedleChecksum instead of silently returned garbage.
+func TestSuperBlockAddGetChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "bfs_block_")
+	if err != nil {
+		t.Fatalf("TempFile() error(%v)", err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	b, err := NewSuperBlock(path, false, SuperBlockOptions{})
+	if err != nil {
+		t.Fatalf("NewSuperBlock() error(%v)", err)
+	}
+	defer b.Close()
+
+	data := []byte("hello bfs")
+	offset, size, err := b.Add(1, 2, data)
+	if err != nil {
+		t.Fatalf("Add() error(%v)", err)
+	}
+	if err = b.Flush(); err != nil {
+		t.Fatalf("Flush() error(%v)", err)
+	}
+
+	buf := make([]byte, size)
+	if err = b.Get(offset, buf); err != nil {
+		t.Fatalf("Get() error(%v)", err)
+	}
+
+	// flip a data byte on disk; Get must now refuse the read instead of
+	// handing back bytes that no longer match their footer.
+	corrupt := buf[NeedleHeaderSize] ^ 0xff
+	if _, err = b.w.WriteAt([]byte{corrupt}, BlockOffset(offset)+int64(NeedleHeaderSize)); err != nil {
+		t.Fatalf("WriteAt() error(%v)", err)
+	}
+	if err = b.Get(offset, buf); err != ErrNeedleChecksum {
+		t.Fatalf("Get() after corruption error = %v, want ErrNeedleChecksum", err)
+	}
+}
+
+// TestSuperBlockCompactRefusesMmap exercises Compact/CommitCompact against
+// an mmap-opened SuperBlock: neither can remap the renamed file in place
+// yet, so both must refuse with ErrSuperBlockMmapCompact instead of the
+// nil-deref/stale-mapping corruption an unguarded CommitCompact would hit.
+func TestSuperBlockCompactRefusesMmap(t *testing.T) {
+	f, err := ioutil.TempFile("", "bfs_block_")
+	if err != nil {
+		t.Fatalf("TempFile() error(%v)", err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	b, err := NewSuperBlock(path, false, SuperBlockOptions{MemoryMapMaxSizeMb: 1})
+	if err != nil {
+		t.Fatalf("NewSuperBlock() error(%v)", err)
+	}
+	defer b.Close()
+	if b.mmapped == nil {
+		t.Skip("mmap backend unavailable on this platform")
+	}
+
+	idxFile := path + ".idx"
+	defer os.Remove(idxFile)
+	indexer, err := NewIndexer(idxFile)
+	if err != nil {
+		t.Fatalf("NewIndexer() error(%v)", err)
+	}
+	defer indexer.Close()
+
+	if err = b.Compact(indexer); err != ErrSuperBlockMmapCompact {
+		t.Fatalf("Compact() on mmap block error = %v, want ErrSuperBlockMmapCompact", err)
+	}
+	if err = b.CommitCompact(indexer); err != ErrSuperBlockMmapCompact {
+		t.Fatalf("CommitCompact() on mmap block error = %v, want ErrSuperBlockMmapCompact", err)
+	}
+}
+
+// TestSuperBlockGetMmapBounds confirms an out-of-range offset on the mmap
+// backend returns ErrSuperBlockMmapBounds instead of panicking with a
+// slice-bounds-out-of-range, as ReadAt already does on the default backend.
+func TestSuperBlockGetMmapBounds(t *testing.T) {
+	f, err := ioutil.TempFile("", "bfs_block_")
+	if err != nil {
+		t.Fatalf("TempFile() error(%v)", err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	b, err := NewSuperBlock(path, false, SuperBlockOptions{MemoryMapMaxSizeMb: 1})
+	if err != nil {
+		t.Fatalf("NewSuperBlock() error(%v)", err)
+	}
+	defer b.Close()
+	if b.mmapped == nil {
+		t.Skip("mmap backend unavailable on this platform")
+	}
+
+	past := FromActualOffset(int64(len(b.mmapped)) * 2)
+	buf := make([]byte, NeedleHeaderSize+NeedleFooterSize)
+	if err = b.Get(past, buf); err != ErrSuperBlockMmapBounds {
+		t.Fatalf("Get() past mmap bounds error = %v, want ErrSuperBlockMmapBounds", err)
+	}
+	if _, _, err = b.GetZeroCopy(past, int32(len(buf))); err != ErrSuperBlockMmapBounds {
+		t.Fatalf("GetZeroCopy() past mmap bounds error = %v, want ErrSuperBlockMmapBounds", err)
+	}
+}